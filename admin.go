@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/hagen1778/chproxy/config"
+)
+
+// buildVersion and buildGitSHA are populated at build time via
+// -ldflags "-X main.buildVersion=... -X main.buildGitSHA=..."
+var (
+	buildVersion = "unknown"
+	buildGitSHA  = "unknown"
+)
+
+// newAdminMux builds the admin/introspection HTTP handler served on
+// a separate listener (config.Admin.ListenAddr), so it can stay reachable
+// even when the main proxy listener is under load or misconfigured
+func newAdminMux(rp *reverseProxy, cfg config.Admin) (http.Handler, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", rp.handleHealth)
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/clusters", rp.handleClusters)
+	mux.HandleFunc("/config", rp.handleConfig)
+	mux.HandleFunc("/-/reload", rp.handleReload)
+
+	return adminAuth(mux, cfg)
+}
+
+// ListenAndServeAdmin starts the admin HTTP server on cfg.ListenAddr.
+// It blocks until the listener fails, same as http.ListenAndServe.
+func ListenAndServeAdmin(rp *reverseProxy, cfg config.Admin) error {
+	mux, err := newAdminMux(rp, cfg)
+	if err != nil {
+		return fmt.Errorf("can't build admin mux: %s", err)
+	}
+
+	return http.ListenAndServe(cfg.ListenAddr, mux)
+}
+
+// adminAuth wraps h with either basic-auth against cfg.Users or an IP
+// allowlist against cfg.AllowedNetworks, whichever is configured
+func adminAuth(h http.Handler, cfg config.Admin) (http.Handler, error) {
+	if len(cfg.AllowedNetworks) == 0 && len(cfg.Users) == 0 {
+		return h, nil
+	}
+
+	nets := make([]*net.IPNet, 0, len(cfg.AllowedNetworks))
+	for _, n := range cfg.AllowedNetworks {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin.allowed_networks entry %q: %s", n, err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	users := make(map[string]string, len(cfg.Users))
+	for _, u := range cfg.Users {
+		users[u.Name] = u.Password
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(nets) > 0 {
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				host = req.RemoteAddr
+			}
+			ip := net.ParseIP(host)
+
+			allowed := false
+			for _, n := range nets {
+				if ip != nil && n.Contains(ip) {
+					allowed = true
+					break
+				}
+			}
+			if allowed {
+				h.ServeHTTP(rw, req)
+				return
+			}
+		}
+
+		if len(users) > 0 {
+			name, password, ok := req.BasicAuth()
+			if ok && users[name] == password {
+				h.ServeHTTP(rw, req)
+				return
+			}
+		}
+
+		rw.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+	}), nil
+}
+
+// handleHealth reports 200 only when every cluster has at least one
+// currently-healthy host, and 503 otherwise
+func (rp *reverseProxy) handleHealth(rw http.ResponseWriter, req *http.Request) {
+	rp.Lock()
+	clusters := rp.clusters
+	rp.Unlock()
+
+	for name, c := range clusters {
+		if !c.hasHealthyHost() {
+			http.Error(rw, fmt.Sprintf("cluster %q has no healthy hosts", name), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleVersion(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, map[string]string{
+		"version":    buildVersion,
+		"git_sha":    buildGitSHA,
+		"go_version": runtime.Version(),
+	})
+}
+
+type clusterStatus struct {
+	Name  string       `json:"name"`
+	Hosts []hostStatus `json:"hosts"`
+}
+
+type hostStatus struct {
+	Addr           string `json:"addr"`
+	State          string `json:"state"`
+	RunningQueries uint32 `json:"running_queries"`
+}
+
+// handleClusters returns each cluster's hosts along with their running
+// query counts and current health state
+func (rp *reverseProxy) handleClusters(rw http.ResponseWriter, req *http.Request) {
+	rp.Lock()
+	clusters := rp.clusters
+	rp.Unlock()
+
+	statuses := make([]clusterStatus, 0, len(clusters))
+	for name, c := range clusters {
+		c.Lock()
+		hosts := make([]hostStatus, len(c.hosts))
+		for i, h := range c.hosts {
+			h.Lock()
+			hosts[i] = hostStatus{
+				Addr:           h.addr.Host,
+				State:          h.state.String(),
+				RunningQueries: h.runningQueries,
+			}
+			h.Unlock()
+		}
+		c.Unlock()
+
+		statuses = append(statuses, clusterStatus{Name: name, Hosts: hosts})
+	}
+
+	writeJSON(rw, statuses)
+}
+
+// handleConfig returns the effective configuration with all passwords masked
+func (rp *reverseProxy) handleConfig(rw http.ResponseWriter, req *http.Request) {
+	rp.Lock()
+	cfg := rp.cfg
+	rp.Unlock()
+
+	if cfg == nil {
+		http.Error(rw, "no config loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(rw, maskPasswords(cfg))
+}
+
+// handleReload triggers a config reload from the last loaded config file
+// and reports validation errors as JSON instead of failing silently
+func (rp *reverseProxy) handleReload(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rp.Lock()
+	file := rp.configFile
+	rp.Unlock()
+
+	if file == "" {
+		http.Error(rw, "no config file known to reload", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := rp.ReloadConfig(file); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		writeJSON(rw, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(rw, map[string]string{"status": "reloaded"})
+}
+
+func (c *cluster) hasHealthyHost() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, h := range c.hosts {
+		if h.isHealthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// maskPasswords round-trips cfg through JSON and blanks out any object key
+// whose name contains "password", so /config never leaks credentials
+// regardless of where new password-like fields get added in the future
+func maskPasswords(cfg *config.Config) interface{} {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+
+	return maskValue(generic)
+}
+
+func maskValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range val {
+			if strings.Contains(strings.ToLower(k), "password") {
+				val[k] = "***"
+				continue
+			}
+			val[k] = maskValue(sub)
+		}
+		return val
+	case []interface{}:
+		for i, sub := range val {
+			val[i] = maskValue(sub)
+		}
+		return val
+	default:
+		return val
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hagen1778/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheEntry is a cached response: enough to replay it verbatim for a
+// later identical query without re-asking ClickHouse
+type cacheEntry struct {
+	StatusCode  int
+	ContentType string
+	Format      string
+	Body        []byte
+}
+
+// Cache stores cacheEntry values keyed by an opaque cache key, expiring
+// them after the ttl passed to Set. Implementations must be safe for
+// concurrent use.
+type Cache interface {
+	Get(key string) (*cacheEntry, bool)
+	Set(key string, entry *cacheEntry, ttl time.Duration)
+}
+
+// newCache builds the Cache backend named by cfg.Mode ("memory", the
+// default, or "redis"). label identifies the owner (an initial-user name)
+// for the cache_bytes metric.
+func newCache(cfg config.Cache, label string) (Cache, error) {
+	switch cfg.Mode {
+	case "", "memory":
+		return newMemoryCache(cfg.MaxSizeBytes, label), nil
+	case "redis":
+		return newRedisCache(cfg.Redis)
+	default:
+		return nil, fmt.Errorf("unknown cache mode %q", cfg.Mode)
+	}
+}
+
+// memoryCache is an in-process LRU, evicting the least-recently-used
+// entry once maxSize bytes (0 meaning unlimited) would otherwise be
+// exceeded.
+type memoryCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+
+	label string
+}
+
+type memoryCacheItem struct {
+	key       string
+	entry     *cacheEntry
+	expiresAt time.Time
+}
+
+func newMemoryCache(maxSizeBytes int64, label string) *memoryCache {
+	return &memoryCache{
+		maxSize: maxSizeBytes,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		label:   label,
+	}
+}
+
+func (c *memoryCache) Get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := el.Value.(*memoryCacheItem)
+	if time.Now().After(item.expiresAt) {
+		c.removeElementLocked(el)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return item.entry, true
+}
+
+func (c *memoryCache) Set(key string, entry *cacheEntry, ttl time.Duration) {
+	size := int64(len(entry.Body))
+	if c.maxSize > 0 && size > c.maxSize {
+		// can never fit even as the sole entry - not worth storing
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElementLocked(el)
+	}
+
+	for c.maxSize > 0 && c.size+size > c.maxSize && c.ll.Len() > 0 {
+		c.removeElementLocked(c.ll.Back())
+	}
+
+	el := c.ll.PushFront(&memoryCacheItem{key: key, entry: entry, expiresAt: time.Now().Add(ttl)})
+	c.items[key] = el
+	c.size += size
+	cacheBytes.With(prometheus.Labels{"user": c.label}).Set(float64(c.size))
+}
+
+func (c *memoryCache) removeElementLocked(el *list.Element) {
+	item := el.Value.(*memoryCacheItem)
+	delete(c.items, item.key)
+	c.ll.Remove(el)
+	c.size -= int64(len(item.entry.Body))
+	cacheBytes.With(prometheus.Labels{"user": c.label}).Set(float64(c.size))
+}
+
+// redisCache stores entries in Redis, keyed as-is, so multiple chproxy
+// replicas behind the same Redis share a cache
+type redisCache struct {
+	client *redis.Client
+}
+
+func newRedisCache(cfg config.RedisConfig) (*redisCache, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("redis cache: addr is required")
+	}
+
+	return &redisCache{
+		client: redis.NewClient(&redis.Options{
+			Addr:     cfg.Addr,
+			Password: cfg.Password,
+			DB:       cfg.DB,
+		}),
+	}, nil
+}
+
+func (c *redisCache) Get(key string) (*cacheEntry, bool) {
+	b, err := c.client.Get(context.Background(), key).Bytes()
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (c *redisCache) Set(key string, entry *cacheEntry, ttl time.Duration) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	c.client.Set(context.Background(), key, b, ttl)
+}
+
+// responseCache fronts a Cache backend for a single initial-user: it
+// enforces that user's cache.ttl/max_entry_bytes and collapses concurrent
+// requests for the same key into a single call to fn via singleflight, so
+// a thundering herd of identical queries only reaches ClickHouse once.
+//
+// A zero value (ttl <= 0, i.e. no cache block configured for the user)
+// disables caching: enabled reports false and fetch always calls fn.
+type responseCache struct {
+	cache Cache
+	group singleflight.Group
+
+	cfg           config.Cache
+	ttl           time.Duration
+	maxEntryBytes int64
+
+	label string
+}
+
+// newResponseCache builds the per-user response cache described by cfg.
+// label identifies the user for metrics.
+func newResponseCache(cfg config.Cache, label string) (*responseCache, error) {
+	rc := &responseCache{
+		cfg:           cfg,
+		ttl:           cfg.TTL,
+		maxEntryBytes: cfg.MaxEntryBytes,
+		label:         label,
+	}
+	if rc.ttl <= 0 {
+		return rc, nil
+	}
+
+	cache, err := newCache(cfg, label)
+	if err != nil {
+		return nil, err
+	}
+	rc.cache = cache
+
+	return rc, nil
+}
+
+func (rc *responseCache) enabled() bool {
+	return rc != nil && rc.cache != nil
+}
+
+// fetch returns the entry for key, calling fn to produce it on a miss.
+// Concurrent fetch calls for the same key share one call to fn.
+func (rc *responseCache) fetch(key string, fn func() (*cacheEntry, error)) (*cacheEntry, error) {
+	if !rc.enabled() {
+		return fn()
+	}
+
+	label := prometheus.Labels{"user": rc.label}
+
+	if entry, ok := rc.cache.Get(key); ok {
+		cacheHits.With(label).Inc()
+		return entry, nil
+	}
+	cacheMisses.With(label).Inc()
+
+	v, err, shared := rc.group.Do(key, func() (interface{}, error) {
+		if entry, ok := rc.cache.Get(key); ok {
+			return entry, nil
+		}
+
+		entry, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		if entry.StatusCode == http.StatusOK && (rc.maxEntryBytes <= 0 || int64(len(entry.Body)) <= rc.maxEntryBytes) {
+			rc.cache.Set(key, entry, rc.ttl)
+		}
+		return entry, nil
+	})
+	if shared {
+		singleflightShared.With(label).Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*cacheEntry), nil
+}
+
+// cacheableQuery extracts the SQL text of req, looking at the "query"
+// query-string param first and falling back to the POST body (which it
+// restores afterwards so the body can still be forwarded upstream). It
+// reports ok=false for anything that isn't a cacheable read.
+func cacheableQuery(req *http.Request) (query string, ok bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return "", false
+	}
+
+	query = req.URL.Query().Get("query")
+	if query == "" && req.Method == http.MethodPost {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return "", false
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		query = string(body)
+	}
+
+	return query, isReadOnlyQuery(query)
+}
+
+var readOnlyQueryPrefixes = []string{"SELECT", "WITH", "SHOW", "DESCRIBE"}
+
+// isReadOnlyQuery reports whether query is the kind of read we're willing
+// to cache: a SELECT, WITH (CTE), SHOW or DESCRIBE statement
+func isReadOnlyQuery(query string) bool {
+	q := strings.ToUpper(strings.TrimSpace(query))
+	for _, prefix := range readOnlyQueryPrefixes {
+		if strings.HasPrefix(q, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassCache reports whether req opted out of caching via the no-cache
+// request header or a ?cache=0 query param
+func bypassCache(req *http.Request) bool {
+	if strings.Contains(strings.ToLower(req.Header.Get("Cache-Control")), "no-cache") {
+		return true
+	}
+	return req.URL.Query().Get("cache") == "0"
+}
+
+// cacheKey builds the (execution_user, normalized_query, format, params)
+// cache key for req, query already having been read from it by the
+// caller.
+func cacheKey(executionUser, query string, req *http.Request) string {
+	format := req.Header.Get("X-ClickHouse-Format")
+	if format == "" {
+		format = req.URL.Query().Get("default_format")
+	}
+
+	params := make([]string, 0, len(req.URL.Query()))
+	for name, values := range req.URL.Query() {
+		if name == "query" || name == "cache" || name == "default_format" {
+			continue
+		}
+		sort.Strings(values)
+		params = append(params, name+"="+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s",
+		executionUser, strings.Join(strings.Fields(query), " "), format, strings.Join(params, "&"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheRecorder buffers a full response instead of streaming it to a
+// client, so a cacheable request's response can be stored and replayed -
+// including for every request singleflight collapsed onto this one.
+// Like statusRecorder, it can be written from proxyRequest's ServeHTTP
+// goroutine and its timeout/disconnect branch concurrently, so access is
+// guarded by a mutex rather than a bare bool. Unlike statusRecorder,
+// WriteHeader/Write never leave the critical section: everything they do
+// is an in-memory header/slice update, not a call that can block on a
+// slow client, so there's no risk of the lock stalling the timeout path.
+type cacheRecorder struct {
+	header http.Header
+
+	mu          sync.Mutex
+	body        []byte
+	status      int
+	wroteHeader bool
+}
+
+func newCacheRecorder() *cacheRecorder {
+	return &cacheRecorder{header: make(http.Header)}
+}
+
+func (w *cacheRecorder) Header() http.Header { return w.header }
+
+func (w *cacheRecorder) headerWritten() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.wroteHeader
+}
+
+func (w *cacheRecorder) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = http.StatusOK
+	}
+	w.body = append(w.body, b...)
+	return len(b), nil
+}
+
+func (w *cacheRecorder) entry() *cacheEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &cacheEntry{
+		StatusCode:  status,
+		ContentType: w.header.Get("Content-Type"),
+		Format:      w.header.Get("X-ClickHouse-Format"),
+		Body:        w.body,
+	}
+}
+
+// respondToProxyErr writes the right HTTP response for an error out of
+// executeForCache: a limiter rejection (429/503) or, for anything else,
+// whatever respondWithErr already does for a plain proxying failure
+func respondToProxyErr(rw http.ResponseWriter, err error) {
+	if errors.Is(err, errRateLimited) || errors.Is(err, errQueueTimeout) {
+		respondWithLimitErr(rw, err)
+		return
+	}
+	respondWithErr(rw, err)
+}
+
+// writeCacheEntry replays a cached (or just-produced) response to rw
+func writeCacheEntry(rw http.ResponseWriter, entry *cacheEntry) {
+	if entry.ContentType != "" {
+		rw.Header().Set("Content-Type", entry.ContentType)
+	}
+	if entry.Format != "" {
+		rw.Header().Set("X-ClickHouse-Format", entry.Format)
+	}
+	rw.WriteHeader(entry.StatusCode)
+	rw.Write(entry.Body)
+}
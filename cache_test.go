@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheGetSetRoundTrip(t *testing.T) {
+	c := newMemoryCache(0, "u")
+
+	entry := &cacheEntry{StatusCode: 200, Body: []byte("hello")}
+	c.Set("k", entry, time.Minute)
+
+	got, ok := c.Get("k")
+	if !ok {
+		t.Fatalf("expected a cache hit")
+	}
+	if string(got.Body) != "hello" {
+		t.Fatalf("got body %q, want %q", got.Body, "hello")
+	}
+}
+
+func TestMemoryCacheExpires(t *testing.T) {
+	c := newMemoryCache(0, "u")
+	c.Set("k", &cacheEntry{Body: []byte("hello")}, time.Millisecond)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("k"); ok {
+		t.Fatalf("expected entry to have expired")
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// each entry is 1 byte, room for exactly 2
+	c := newMemoryCache(2, "u")
+
+	c.Set("a", &cacheEntry{Body: []byte("a")}, time.Minute)
+	c.Set("b", &cacheEntry{Body: []byte("b")}, time.Minute)
+
+	// touch "a" so "b" becomes the least-recently-used entry
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("expected a to still be cached")
+	}
+
+	c.Set("c", &cacheEntry{Body: []byte("c")}, time.Minute)
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("expected b to have been evicted as the least-recently-used entry")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("expected a to survive eviction since it was just accessed")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Fatalf("expected c to have been admitted")
+	}
+}
+
+func TestMemoryCacheRejectsEntryLargerThanMaxSize(t *testing.T) {
+	c := newMemoryCache(1, "u")
+	c.Set("big", &cacheEntry{Body: []byte("too big")}, time.Minute)
+
+	if _, ok := c.Get("big"); ok {
+		t.Fatalf("an entry that can never fit should not be stored")
+	}
+}
+
+func TestMemoryCacheOverwriteUpdatesSize(t *testing.T) {
+	c := newMemoryCache(2, "u")
+
+	c.Set("k", &cacheEntry{Body: []byte("a")}, time.Minute)
+	c.Set("k", &cacheEntry{Body: []byte("bb")}, time.Minute)
+
+	got, ok := c.Get("k")
+	if !ok {
+		t.Fatalf("expected the overwritten entry to still be cached")
+	}
+	if string(got.Body) != "bb" {
+		t.Fatalf("got body %q, want %q", got.Body, "bb")
+	}
+	if c.size != 2 {
+		t.Fatalf("got tracked size %d, want 2 after overwrite", c.size)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hagen1778/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hostState describes the current health state of a host as observed
+// by the active health-checker: healthy until cfg.Fails consecutive probes
+// fail, unhealthy until cfg.Passes consecutive probes then succeed
+type hostState int
+
+const (
+	stateHealthy hostState = iota
+	stateUnhealthy
+)
+
+func (s hostState) String() string {
+	switch s {
+	case stateHealthy:
+		return "healthy"
+	case stateUnhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// host represents a single ClickHouse node behind a cluster
+type host struct {
+	sync.Mutex
+
+	addr           *url.URL
+	runningQueries uint32
+
+	// state is the current health state of the host, as determined
+	// by the background health-checker started in cluster.startHealthCheck
+	state hostState
+	// fails/passes count consecutive probe results since the last
+	// state transition
+	fails  int
+	passes int
+
+	stop   chan struct{}
+	logger *slog.Logger
+}
+
+// isHealthy reports whether the host may currently receive requests
+func (h *host) isHealthy() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.state != stateUnhealthy
+}
+
+// runHealthCheck periodically probes the host until stop is closed,
+// updating its state and the host_up/health-check-failure metrics. stop is
+// the channel this goroutine's caller created for it; hosts are reused
+// across config reloads, so it's captured once here rather than read from
+// h.stop on every iteration - otherwise a reload that replaces h.stop with
+// a fresh channel while this goroutine is blocked inside probe() would
+// make it start watching the new channel instead of exiting on the old
+// one, leaking a duplicate checker goroutine for the host.
+func (h *host) runHealthCheck(stop chan struct{}, cfg config.HealthCheck, user, password string) {
+	if cfg.Interval <= 0 {
+		h.logger.Error("health check: refusing to start with a non-positive interval", "interval", cfg.Interval)
+		return
+	}
+
+	label := prometheus.Labels{"host": h.addr.Host}
+	up := 0.0
+	if h.isHealthy() {
+		up = 1
+	}
+	hostUp.With(label).Set(up)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.probe(cfg, user, password, label)
+		}
+	}
+}
+
+func (h *host) probe(cfg config.HealthCheck, user, password string, label prometheus.Labels) {
+	probeURL := fmt.Sprintf("%s://%s%s", h.addr.Scheme, h.addr.Host, cfg.Path)
+	req, err := http.NewRequest("GET", probeURL, nil)
+	if err != nil {
+		h.logger.Error("health check: can't build probe request", "err", err)
+		return
+	}
+	req.SetBasicAuth(user, password)
+
+	client := http.Client{Timeout: cfg.Timeout}
+	resp, err := client.Do(req)
+	ok := err == nil && resp.StatusCode == http.StatusOK
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	h.recordProbeResult(ok, cfg, label, err)
+}
+
+// recordProbeResult applies the outcome of a single probe to the host's
+// consecutive fail/pass counters and transitions state once either
+// threshold in cfg is reached, resetting the other counter along the way.
+// probeErr is only used for logging and may be nil.
+func (h *host) recordProbeResult(ok bool, cfg config.HealthCheck, label prometheus.Labels, probeErr error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if ok {
+		h.passes++
+		h.fails = 0
+		if h.state != stateHealthy && h.passes >= cfg.Passes {
+			h.state = stateHealthy
+			hostUp.With(label).Set(1)
+			h.logger.Info("health check: host is healthy again")
+		}
+		return
+	}
+
+	healthCheckFailures.With(label).Inc()
+	h.fails++
+	h.passes = 0
+	if h.state != stateUnhealthy && h.fails >= cfg.Fails {
+		h.state = stateUnhealthy
+		hostUp.With(label).Set(0)
+		h.logger.Error("health check: host marked unhealthy", "err", probeErr)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hagen1778/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestHost(t *testing.T) *host {
+	t.Helper()
+
+	addr, err := url.Parse("http://127.0.0.1:8123")
+	if err != nil {
+		t.Fatalf("can't parse test addr: %s", err)
+	}
+
+	return &host{
+		addr:   addr,
+		logger: slog.Default(),
+	}
+}
+
+func TestHostProbeStateTransitions(t *testing.T) {
+	cfg := config.HealthCheck{Fails: 2, Passes: 2}
+	h := newTestHost(t)
+	label := prometheus.Labels{"host": h.addr.Host}
+
+	if !h.isHealthy() {
+		t.Fatalf("host should start healthy")
+	}
+
+	// a single failure shouldn't eject the host yet
+	h.recordProbeResult(false, cfg, label, nil)
+	if !h.isHealthy() {
+		t.Fatalf("host should stay healthy below the fails threshold")
+	}
+
+	// the second consecutive failure should
+	h.recordProbeResult(false, cfg, label, nil)
+	if h.isHealthy() {
+		t.Fatalf("host should be unhealthy once fails reaches the threshold")
+	}
+
+	// a single success shouldn't bring it back yet
+	h.recordProbeResult(true, cfg, label, nil)
+	if h.isHealthy() {
+		t.Fatalf("host should stay unhealthy below the passes threshold")
+	}
+
+	// a subsequent failure must reset the accumulated passes
+	h.recordProbeResult(false, cfg, label, nil)
+	h.recordProbeResult(true, cfg, label, nil)
+	if h.isHealthy() {
+		t.Fatalf("a failure in between successes should reset the passes counter")
+	}
+
+	// the second consecutive success should recover it
+	h.recordProbeResult(true, cfg, label, nil)
+	if !h.isHealthy() {
+		t.Fatalf("host should be healthy again once passes reaches the threshold")
+	}
+}
+
+func TestHostRunHealthCheckRejectsNonPositiveInterval(t *testing.T) {
+	h := newTestHost(t)
+
+	// with a non-positive interval, runHealthCheck must return right away
+	// instead of calling time.NewTicker (which panics for <= 0 durations)
+	h.runHealthCheck(make(chan struct{}), config.HealthCheck{Interval: 0}, "default", "")
+}
+
+func TestHostRunHealthCheckUsesCapturedStopChannel(t *testing.T) {
+	h := newTestHost(t)
+	cfg := config.HealthCheck{Interval: 5 * time.Millisecond, Timeout: 5 * time.Millisecond, Fails: 1, Passes: 1}
+
+	stop := make(chan struct{})
+	h.stop = stop
+
+	done := make(chan struct{})
+	go func() {
+		h.runHealthCheck(stop, cfg, "default", "")
+		close(done)
+	}()
+
+	// simulate a reload landing while the goroutine above is still running:
+	// startHealthCheck would overwrite h.stop with a fresh channel here,
+	// but the running goroutine was handed its own stop channel explicitly
+	// rather than re-reading h.stop on every loop, so this must not affect it
+	h.stop = make(chan struct{})
+
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("runHealthCheck should exit once its own stop channel is closed, even after h.stop is replaced")
+	}
+}
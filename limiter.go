@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hagen1778/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errRateLimited  = errors.New("rate limit exceeded")
+	errQueueTimeout = errors.New("timed out waiting in queue")
+)
+
+// limiter is a token-bucket rate limiter with an optional bounded queue
+// in front of it, used to smooth bursts above requests_per_second
+// instead of rejecting them outright. Queued requests poll for a token
+// every pollInterval; they are not admitted in arrival order, and a newly
+// arriving request can take a token ahead of them. A nil *limiter, or one
+// built with a non-positive rate, always allows the request through.
+type limiter struct {
+	mu    sync.Mutex
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+
+	queueSize    int
+	maxQueueSize int
+	maxQueueTime time.Duration
+
+	label   string
+	metrics limiterMetrics
+}
+
+// limiterMetrics bundles the three Prometheus vecs a limiter reports to,
+// keyed under a single label key. userLimiterMetrics and clusterLimiterMetrics
+// below use distinct label keys ("user" vs "cluster") so a user and a
+// cluster that happen to share a name can't be conflated in the same
+// dimension on a dashboard.
+type limiterMetrics struct {
+	queueSize        *prometheus.GaugeVec
+	queueWaitSeconds *prometheus.HistogramVec
+	rateLimited      *prometheus.CounterVec
+	labelKey         string
+}
+
+var userLimiterMetrics = limiterMetrics{
+	queueSize:        queueSize,
+	queueWaitSeconds: queueWaitSeconds,
+	rateLimited:      rateLimited,
+	labelKey:         "user",
+}
+
+var clusterLimiterMetrics = limiterMetrics{
+	queueSize:        clusterQueueSize,
+	queueWaitSeconds: clusterQueueWaitSeconds,
+	rateLimited:      clusterRateLimited,
+	labelKey:         "cluster",
+}
+
+// newLimiter builds a limiter from a requests_per_second/burst/queue config
+// block. label identifies the owner (a user name or a cluster name) and
+// metrics picks which Prometheus label key it's reported under.
+func newLimiter(cfg config.Limits, label string, metrics limiterMetrics) *limiter {
+	return &limiter{
+		rate:         cfg.RequestsPerSecond,
+		burst:        float64(cfg.Burst),
+		tokens:       float64(cfg.Burst),
+		last:         time.Now(),
+		maxQueueSize: cfg.MaxQueueSize,
+		maxQueueTime: cfg.MaxQueueTime,
+		label:        label,
+		metrics:      metrics,
+	}
+}
+
+// allow reports whether a token is immediately available, consuming one
+// if so
+func (l *limiter) allow() bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+const pollInterval = 20 * time.Millisecond
+
+// wait blocks until a token becomes available or the request should be
+// rejected, returning errRateLimited when there's no room left in the
+// queue and errQueueTimeout when max_queue_time elapses first
+func (l *limiter) wait(ctx context.Context) error {
+	if l.allow() {
+		return nil
+	}
+
+	label := prometheus.Labels{l.metrics.labelKey: l.label}
+
+	if l.maxQueueSize <= 0 {
+		l.metrics.rateLimited.With(label).Inc()
+		return errRateLimited
+	}
+
+	l.mu.Lock()
+	if l.queueSize >= l.maxQueueSize {
+		l.mu.Unlock()
+		l.metrics.rateLimited.With(label).Inc()
+		return errRateLimited
+	}
+	l.queueSize++
+	l.mu.Unlock()
+
+	l.metrics.queueSize.With(label).Inc()
+	defer func() {
+		l.mu.Lock()
+		l.queueSize--
+		l.mu.Unlock()
+		l.metrics.queueSize.With(label).Dec()
+	}()
+
+	start := time.Now()
+	deadline := start.Add(l.maxQueueTime)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			if l.allow() {
+				l.metrics.queueWaitSeconds.With(label).Observe(time.Since(start).Seconds())
+				return nil
+			}
+			if now.After(deadline) {
+				l.metrics.rateLimited.With(label).Inc()
+				return errQueueTimeout
+			}
+		}
+	}
+}
+
+// respondWithLimitErr maps a limiter error onto an HTTP status: 429 with
+// Retry-After on outright rejection, 503 when the request gave up waiting
+// in the queue or its context was canceled
+func respondWithLimitErr(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRateLimited):
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "too many requests", http.StatusTooManyRequests)
+	case errors.Is(err, errQueueTimeout):
+		http.Error(rw, "timed out waiting for a free slot", http.StatusServiceUnavailable)
+	default:
+		http.Error(rw, fmt.Sprintf("request canceled: %s", err), http.StatusServiceUnavailable)
+	}
+}
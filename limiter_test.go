@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hagen1778/chproxy/config"
+)
+
+func TestLimiterAllowConsumesBurstThenBlocks(t *testing.T) {
+	l := newLimiter(config.Limits{RequestsPerSecond: 1, Burst: 2}, "u", userLimiterMetrics)
+
+	if !l.allow() {
+		t.Fatalf("first request within burst should be allowed")
+	}
+	if !l.allow() {
+		t.Fatalf("second request within burst should be allowed")
+	}
+	if l.allow() {
+		t.Fatalf("third request should exhaust the burst and be denied")
+	}
+}
+
+func TestLimiterAllowZeroRateAlwaysAllows(t *testing.T) {
+	l := newLimiter(config.Limits{}, "u", userLimiterMetrics)
+	for i := 0; i < 5; i++ {
+		if !l.allow() {
+			t.Fatalf("a limiter with no configured rate should never deny a request")
+		}
+	}
+}
+
+func TestLimiterNilAlwaysAllows(t *testing.T) {
+	var l *limiter
+	if !l.allow() {
+		t.Fatalf("a nil limiter should always allow")
+	}
+}
+
+func TestLimiterWaitRejectsWithoutQueue(t *testing.T) {
+	l := newLimiter(config.Limits{RequestsPerSecond: 1, Burst: 1}, "u", userLimiterMetrics)
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("first request should be admitted immediately: %s", err)
+	}
+
+	err := l.wait(context.Background())
+	if !errors.Is(err, errRateLimited) {
+		t.Fatalf("expected errRateLimited with no queue configured, got %v", err)
+	}
+}
+
+func TestLimiterWaitQueuesUntilTokenFrees(t *testing.T) {
+	l := newLimiter(config.Limits{
+		RequestsPerSecond: 50,
+		Burst:             1,
+		MaxQueueSize:      1,
+		MaxQueueTime:      time.Second,
+	}, "u", userLimiterMetrics)
+
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("first request should be admitted immediately: %s", err)
+	}
+
+	// the bucket refills at 50/s, so the second request should be let
+	// through out of the queue well within maxQueueTime
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("second request should be admitted out of the queue: %s", err)
+	}
+}
+
+func TestLimiterWaitQueueTimeout(t *testing.T) {
+	l := newLimiter(config.Limits{
+		RequestsPerSecond: 0.001,
+		Burst:             1,
+		MaxQueueSize:      1,
+		MaxQueueTime:      50 * time.Millisecond,
+	}, "u", userLimiterMetrics)
+
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("first request should be admitted immediately: %s", err)
+	}
+
+	err := l.wait(context.Background())
+	if !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("expected errQueueTimeout once max_queue_time elapses, got %v", err)
+	}
+}
+
+func TestLimiterWaitQueueFull(t *testing.T) {
+	l := newLimiter(config.Limits{
+		RequestsPerSecond: 0.001,
+		Burst:             1,
+		MaxQueueSize:      1,
+		MaxQueueTime:      time.Second,
+	}, "u", userLimiterMetrics)
+
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("first request should be admitted immediately: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wait(context.Background())
+		close(done)
+	}()
+
+	// give the goroutine above time to occupy the single queue slot before
+	// a third request finds it full
+	time.Sleep(10 * time.Millisecond)
+
+	err := l.wait(context.Background())
+	if !errors.Is(err, errRateLimited) {
+		t.Fatalf("expected errRateLimited once the queue is full, got %v", err)
+	}
+
+	<-done
+}
+
+func TestLimiterWaitCanceledByContext(t *testing.T) {
+	l := newLimiter(config.Limits{
+		RequestsPerSecond: 0.001,
+		Burst:             1,
+		MaxQueueSize:      1,
+		MaxQueueTime:      time.Second,
+	}, "u", userLimiterMetrics)
+
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("first request should be admitted immediately: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := l.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/hagen1778/chproxy/config"
+)
+
+type ctxKey int
+
+// loggerCtxKey is the context key reverseProxy.ServeHTTP uses to attach a
+// request-scoped logger so that helpers like killQueries and doQuery log
+// with the same correlation fields
+const loggerCtxKey ctxKey = 0
+
+// newLogger builds the process-wide structured logger according to the
+// configured format and level
+func newLogger(cfg config.Log) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLevel(cfg.Level)}
+
+	var handler slog.Handler
+	switch cfg.Format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		// logfmt and text both map onto the stdlib key=value handler
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	return slog.New(handler)
+}
+
+func parseLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// loggerFromContext returns the request-scoped logger attached by
+// reverseProxy.ServeHTTP, falling back to slog.Default() outside of a request
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerCtxKey).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func contextWithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey, l)
+}
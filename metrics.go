@@ -10,6 +10,22 @@ var (
 	errors         *prometheus.CounterVec
 	requestSum     *prometheus.CounterVec
 	requestSuccess *prometheus.CounterVec
+
+	hostUp              *prometheus.GaugeVec
+	healthCheckFailures *prometheus.CounterVec
+
+	queueSize        *prometheus.GaugeVec
+	queueWaitSeconds *prometheus.HistogramVec
+	rateLimited      *prometheus.CounterVec
+
+	clusterQueueSize        *prometheus.GaugeVec
+	clusterQueueWaitSeconds *prometheus.HistogramVec
+	clusterRateLimited      *prometheus.CounterVec
+
+	cacheHits          *prometheus.CounterVec
+	cacheMisses        *prometheus.CounterVec
+	cacheBytes         *prometheus.GaugeVec
+	singleflightShared *prometheus.CounterVec
 )
 
 func init() {
@@ -53,6 +69,108 @@ func init() {
 		[]string{"initial_user", "execution_user", "host"},
 	)
 
+	hostUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "host_up",
+			Help: "Whether the host is currently considered healthy by the health-checker (1) or not (0)",
+		},
+		[]string{"host"},
+	)
+
+	healthCheckFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "host_health_check_failures_total",
+			Help: "Number of failed health-check probes sent to a host",
+		},
+		[]string{"host"},
+	)
+
+	queueSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_size",
+			Help: "Number of requests currently waiting in a rate-limit queue",
+		},
+		[]string{"user"},
+	)
+
+	queueWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "queue_wait_seconds",
+			Help: "Time spent waiting in a rate-limit queue before being admitted",
+		},
+		[]string{"user"},
+	)
+
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limited_total",
+			Help: "Number of requests rejected or timed out by the rate limiter",
+		},
+		[]string{"user"},
+	)
+
+	// cluster-scoped equivalents of the three metrics above, kept under a
+	// "cluster" label key instead of "user" so a cluster and a user that
+	// happen to share a name can't be conflated in the same dimension
+	clusterQueueSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cluster_queue_size",
+			Help: "Number of requests currently waiting in a cluster's rate-limit queue",
+		},
+		[]string{"cluster"},
+	)
+
+	clusterQueueWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "cluster_queue_wait_seconds",
+			Help: "Time spent waiting in a cluster's rate-limit queue before being admitted",
+		},
+		[]string{"cluster"},
+	)
+
+	clusterRateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cluster_rate_limited_total",
+			Help: "Number of requests rejected or timed out by a cluster's rate limiter",
+		},
+		[]string{"cluster"},
+	)
+
+	cacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "Number of requests served from the response cache",
+		},
+		[]string{"user"},
+	)
+
+	cacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "Number of cacheable requests not found in the response cache",
+		},
+		[]string{"user"},
+	)
+
+	cacheBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_bytes",
+			Help: "Total size in bytes of entries currently held by a user's in-memory response cache",
+		},
+		[]string{"user"},
+	)
+
+	singleflightShared = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "singleflight_shared_total",
+			Help: "Number of requests that were served by a concurrent identical request instead of querying ClickHouse themselves",
+		},
+		[]string{"user"},
+	)
+
 	prometheus.MustRegister(statusCodes, timeouts, errors,
-		requestSum, requestSuccess)
+		requestSum, requestSuccess, hostUp, healthCheckFailures,
+		queueSize, queueWaitSeconds, rateLimited,
+		clusterQueueSize, clusterQueueWaitSeconds, clusterRateLimited,
+		cacheHits, cacheMisses, cacheBytes, singleflightShared)
 }
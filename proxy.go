@@ -3,38 +3,30 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"reflect"
 	"sync"
 	"time"
 
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 
+	"github.com/google/uuid"
 	"github.com/hagen1778/chproxy/config"
-	"github.com/hagen1778/chproxy/log"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Creates new reverseProxy with provided config
 func NewReverseProxy(cfg *config.Config) (*reverseProxy, error) {
-	rp := &reverseProxy{}
+	rp := &reverseProxy{
+		logger:    newLogger(cfg.Log),
+		transport: newDispatchTransport(),
+	}
 	rp.ReverseProxy = &httputil.ReverseProxy{
-		Director: func(*http.Request) {},
-		ErrorLog: log.ErrorLogger,
-		Transport: &observableTransport{
-			http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					KeepAlive: 30 * time.Second,
-					DualStack: true,
-				}).DialContext,
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-			},
-		},
+		Director:  func(*http.Request) {},
+		ErrorLog:  slog.NewLogLogger(rp.logger.Handler(), slog.LevelError),
+		Transport: rp.transport,
 	}
 	err := rp.ApplyConfig(cfg)
 
@@ -43,18 +35,104 @@ func NewReverseProxy(cfg *config.Config) (*reverseProxy, error) {
 
 // Serves incoming requests according to config
 func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	log.Debugf("Accepting request from %s: %s", req.RemoteAddr, req.URL.String())
+	reqID := uuid.New().String()
+
 	s, err := rp.getRequestScope(req)
 	if err != nil {
 		respondWithErr(rw, err)
 		return
 	}
-	log.Debugf("Request scope %s", s)
 
-	if err = s.inc(); err != nil {
+	// host isn't known yet (see scope.resolveHost) - it's added to the
+	// logger once a backend actually needs to be reached
+	logger := rp.logger.With(
+		"initial_user", s.initialUser.name,
+		"execution_user", s.executionUser.name,
+		"cluster", s.cluster.name,
+		"remote_addr", req.RemoteAddr,
+		"request_id", reqID,
+	)
+	logger.Debug("accepting request", "url", req.URL.String())
+
+	rp.Lock()
+	userLimiter := rp.userLimiters[s.initialUser.name]
+	userCache := rp.userCaches[s.initialUser.name]
+	rp.Unlock()
+
+	if userCache.enabled() && !bypassCache(req) {
+		if query, ok := cacheableQuery(req); ok {
+			key := cacheKey(s.executionUser.name, query, req)
+			entry, err := userCache.fetch(key, func() (*cacheEntry, error) {
+				return rp.executeForCache(req, s, logger, reqID, userLimiter)
+			})
+			if err != nil {
+				respondToProxyErr(rw, err)
+				return
+			}
+			writeCacheEntry(rw, entry)
+			return
+		}
+	}
+
+	if err := s.resolveHost(); err != nil {
 		respondWithErr(rw, err)
 		return
 	}
+	logger = logger.With("host", s.host.addr.Host)
+
+	if err := userLimiter.wait(req.Context()); err != nil {
+		respondWithLimitErr(rw, err)
+		return
+	}
+	if err := s.cluster.limiter.wait(req.Context()); err != nil {
+		respondWithLimitErr(rw, err)
+		return
+	}
+
+	crw := &statusRecorder{ResponseWriter: rw}
+	if err := rp.proxyRequest(crw, req, s, logger, reqID); err != nil {
+		respondWithErr(rw, err)
+	}
+}
+
+// executeForCache runs the actual upstream round trip for a cacheable
+// query and buffers its response into a *cacheEntry instead of streaming
+// it straight to the client, so it can be replayed for every request the
+// singleflight group collapsed onto this one. Rate limiting happens here,
+// not in ServeHTTP, since a collapsed request never reaches this point and
+// so never needs its own token.
+func (rp *reverseProxy) executeForCache(req *http.Request, s *scope, logger *slog.Logger, reqID string, ul *limiter) (*cacheEntry, error) {
+	if err := s.resolveHost(); err != nil {
+		return nil, err
+	}
+	logger = logger.With("host", s.host.addr.Host)
+
+	if err := ul.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	if err := s.cluster.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	rec := newCacheRecorder()
+	if err := rp.proxyRequest(rec, req, s, logger, reqID); err != nil {
+		return nil, err
+	}
+
+	return rec.entry(), nil
+}
+
+// proxyRequest performs the round trip to s.host for req and writes the
+// response to rw, honoring the combined maxExecutionTime of the initial
+// and execution user and killing the query upstream on timeout or client
+// disconnect. The caller is responsible for rate limiting before calling
+// this; proxyRequest itself only handles the maxConcurrentQueries gate via
+// s.inc()/s.dec().
+func (rp *reverseProxy) proxyRequest(rw recorder, req *http.Request, s *scope, logger *slog.Logger, reqID string) error {
+	if err := s.inc(); err != nil {
+		return err
+	}
+	defer s.dec()
 
 	label := prometheus.Labels{
 		"initial_user":   s.initialUser.name,
@@ -66,40 +144,127 @@ func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	req.URL.Scheme = s.host.addr.Scheme
 	req.URL.Host = s.host.addr.Host
 	// set custom User-Agent for proper handling of killQuery func
-	ua := fmt.Sprintf("ClickHouseProxy: %s", s.initialUser.name)
+	ua := fmt.Sprintf("ClickHouseProxy: %s; request_id: %s", s.initialUser.name, reqID)
 	req.Header.Set("User-Agent", ua)
+	req.Header.Set("X-Request-ID", reqID)
 
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+	start := time.Now()
+	timeout := minDuration(s.initialUser.maxExecutionTime, s.executionUser.maxExecutionTime)
+
+	// a single derived deadline, rather than racing two non-deterministic
+	// time.After timers against each other; ctx.Done() also fires on client
+	// disconnect (req.Context() is its parent), and cancel() below stops the
+	// underlying timer on the success path instead of leaking it
+	ctx, cancel := context.WithTimeout(contextWithLogger(req.Context(), logger), timeout)
+	defer cancel()
 	req = req.WithContext(ctx)
 
 	c := make(chan struct{})
 	go func() {
 		rp.ReverseProxy.ServeHTTP(rw, req)
-		c <- struct{}{}
+		close(c)
 	}()
 
+	status := "success"
 	select {
-	case <-time.After(s.initialUser.maxExecutionTime):
-		cancel()
-		timeouts.With(label).Inc()
+	case <-ctx.Done():
 		condition := fmt.Sprintf("http_user_agent = '%s'", ua)
-		s.cluster.killQueries(condition, s.initialUser.maxExecutionTime.Seconds())
-		message := fmt.Sprintf("timeout for initial user %q exceeded: %v", s.initialUser.name, s.initialUser.maxExecutionTime)
-		rw.Write([]byte(message))
-	case <-time.After(s.executionUser.maxExecutionTime):
-		cancel()
-		timeouts.With(label).Inc()
-		condition := fmt.Sprintf("initial_user = '%s'", s.executionUser.name)
-		s.cluster.killQueries(condition, s.executionUser.maxExecutionTime.Seconds())
-		message := fmt.Sprintf("timeout for execution user %q exceeded: %v", s.executionUser.name, s.executionUser.maxExecutionTime)
-		rw.Write([]byte(message))
+		if ctx.Err() == context.DeadlineExceeded {
+			status = "timeout"
+			timeouts.With(label).Inc()
+			s.cluster.killQueries(logger, condition, timeout.Seconds())
+			writeTimeoutResponse(rw, timeout)
+		} else {
+			// client disconnected before the deadline: don't leave a heavy
+			// query running on ClickHouse just because nobody is listening
+			status = "disconnected"
+			s.cluster.killQueries(logger, condition, 0)
+		}
 	case <-c:
 		requestSuccess.With(label).Inc()
 	}
 
-	s.dec()
-	log.Debugf("Request scope %s successfully proxied", s)
+	logger.Debug("request proxied", "duration_ms", time.Since(start).Milliseconds(), "status", status)
+	return nil
+}
+
+// minDuration returns the smaller of a and b
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// recorder is the subset of a buffering/passthrough ResponseWriter that
+// writeTimeoutResponse needs: enough to tell whether a response has
+// already started and to write a fallback one if not
+type recorder interface {
+	http.ResponseWriter
+	headerWritten() bool
+}
+
+// writeTimeoutResponse writes a 504 response unless the upstream has
+// already started writing one, which rw would have already recorded
+func writeTimeoutResponse(rw recorder, timeout time.Duration) {
+	if rw.headerWritten() {
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusGatewayTimeout)
+	fmt.Fprintf(rw, "timeout after %v", timeout)
+}
+
+// statusRecorder wraps a ResponseWriter to detect whether headers have
+// already been written, so the timeout path doesn't clobber a response
+// the upstream handler may already be streaming back. proxyRequest's
+// ServeHTTP goroutine and its select's timeout/disconnect branch can both
+// write through the same recorder, so access to wroteHeader/status is
+// guarded by a mutex rather than a bare bool. The mutex only ever guards
+// that bookkeeping, never the call to the underlying ResponseWriter itself:
+// that call can block for a long time against a slow or stalled client, and
+// the timeout/disconnect branch must still be able to check headerWritten()
+// promptly while it's blocked.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	mu          sync.Mutex
+	wroteHeader bool
+	status      int
+}
+
+func (w *statusRecorder) headerWritten() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.wroteHeader
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.mu.Lock()
+	if w.wroteHeader {
+		w.mu.Unlock()
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	w.mu.Unlock()
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	first := !w.wroteHeader
+	if first {
+		w.wroteHeader = true
+		w.status = http.StatusOK
+	}
+	w.mu.Unlock()
+
+	if first {
+		w.ResponseWriter.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
 }
 
 // Reloads configuration from passed file
@@ -110,7 +275,15 @@ func (rp *reverseProxy) ReloadConfig(file string) error {
 		return fmt.Errorf("can't load config %q: %s", file, err)
 	}
 
-	return rp.ApplyConfig(cfg)
+	if err := rp.ApplyConfig(cfg); err != nil {
+		return err
+	}
+
+	rp.Lock()
+	rp.configFile = file
+	rp.Unlock()
+
+	return nil
 }
 
 // Applies provided config to reverseProxy
@@ -123,8 +296,30 @@ func (rp *reverseProxy) ApplyConfig(cfg *config.Config) error {
 	rp.Lock()
 	defer rp.Unlock()
 
+	rp.logger = newLogger(cfg.Log)
+	rp.ErrorLog = slog.NewLogLogger(rp.logger.Handler(), slog.LevelError)
+
+	// stop health-checkers of the cluster set being replaced so they don't
+	// leak goroutines; in-flight requests already hold their own *host
+	// reference and are unaffected
+	for _, c := range rp.clusters {
+		c.stopHealthCheck()
+	}
+
 	clusters := make(map[string]*cluster)
 	for _, c := range cfg.Clusters {
+		// reuse the previous *host objects for nodes that are still part of
+		// this cluster, so their accumulated health-check state (fails/
+		// passes/state) survives a reload for an unrelated reason instead of
+		// resetting every host to "healthy" and briefly routing traffic back
+		// to a host that was already confirmed down
+		prevHostsByAddr := make(map[string]*host)
+		if prev, ok := rp.clusters[c.Name]; ok {
+			for _, h := range prev.hosts {
+				prevHostsByAddr[h.addr.String()] = h
+			}
+		}
+
 		hosts := make([]*host, len(c.Nodes))
 		for i, node := range c.Nodes {
 			addr, err := url.Parse(fmt.Sprintf("%s://%s", c.Scheme, node))
@@ -132,8 +327,12 @@ func (rp *reverseProxy) ApplyConfig(cfg *config.Config) error {
 				return err
 			}
 
-			hosts[i] = &host{
-				addr: addr,
+			if h, ok := prevHostsByAddr[addr.String()]; ok {
+				hosts[i] = h
+			} else {
+				hosts[i] = &host{
+					addr: addr,
+				}
 			}
 		}
 
@@ -145,12 +344,50 @@ func (rp *reverseProxy) ApplyConfig(cfg *config.Config) error {
 			}
 		}
 
-		clusters[c.Name] = &cluster{
-			hosts: hosts,
-			users: users,
+		// reuse the previous transport (and its idle connection pool) when
+		// this cluster's transport-affecting settings haven't changed; an
+		// unrelated change elsewhere in the cluster block (limits,
+		// health_check, ...) must not force a rebuild
+		transportCfg := newTransportSettings(c)
+		var tr *observableTransport
+		if prev, ok := rp.clusters[c.Name]; ok && reflect.DeepEqual(prev.transportCfg, transportCfg) {
+			tr = prev.transport
+		} else {
+			var err error
+			tr, err = buildTransport(c)
+			if err != nil {
+				return fmt.Errorf("cluster %q: %s", c.Name, err)
+			}
+		}
+
+		clusterObj := &cluster{
+			name:         c.Name,
+			hosts:        hosts,
+			users:        users,
+			transport:    tr,
+			transportCfg: transportCfg,
+			limiter:      newLimiter(c.Limits, c.Name, clusterLimiterMetrics),
+		}
+
+		// health_check is optional: a cluster that doesn't configure one (or
+		// sets a non-positive interval) just isn't actively health-checked,
+		// rather than crashing the process via a zero-duration time.NewTicker
+		if len(c.OutUsers) > 0 && c.HealthCheck.Interval > 0 {
+			hcUser := c.OutUsers[0]
+			clusterObj.startHealthCheck(c.HealthCheck, hcUser.Name, hcUser.Password, rp.logger)
 		}
+
+		clusters[c.Name] = clusterObj
 	}
 
+	byHost := make(map[string]*observableTransport)
+	for _, c := range clusters {
+		for _, h := range c.hosts {
+			byHost[h.addr.Host] = c.transport
+		}
+	}
+	rp.transport.set(byHost)
+
 	initialUsers := make(map[string]*initialUser, len(cfg.GlobalUsers))
 	for _, u := range cfg.GlobalUsers {
 		c, ok := clusters[u.ToCluster]
@@ -173,11 +410,33 @@ func (rp *reverseProxy) ApplyConfig(cfg *config.Config) error {
 		}
 	}
 
+	userLimiters := make(map[string]*limiter, len(cfg.GlobalUsers))
+	for _, u := range cfg.GlobalUsers {
+		userLimiters[u.Name] = newLimiter(u.Limits, u.Name, userLimiterMetrics)
+	}
+
+	userCaches := make(map[string]*responseCache, len(cfg.GlobalUsers))
+	for _, u := range cfg.GlobalUsers {
+		// reuse the previous cache (and its contents) when this user's
+		// cache settings haven't changed, same as transport reuse above -
+		// only an actual settings change invalidates it
+		if prev, ok := rp.userCaches[u.Name]; ok && reflect.DeepEqual(prev.cfg, u.Cache) {
+			userCaches[u.Name] = prev
+			continue
+		}
+
+		rc, err := newResponseCache(u.Cache, u.Name)
+		if err != nil {
+			return fmt.Errorf("user %q: cache: %s", u.Name, err)
+		}
+		userCaches[u.Name] = rc
+	}
+
 	rp.clusters = clusters
 	rp.users = initialUsers
-
-	// Next statement looks a bit outplaced. Still don't know where it must be placed
-	log.SetDebug(cfg.LogDebug)
+	rp.userLimiters = userLimiters
+	rp.userCaches = userCaches
+	rp.cfg = cfg
 
 	return nil
 }
@@ -186,23 +445,35 @@ type reverseProxy struct {
 	*httputil.ReverseProxy
 
 	sync.Mutex
-	users    map[string]*initialUser
-	clusters map[string]*cluster
+	users        map[string]*initialUser
+	clusters     map[string]*cluster
+	userLimiters map[string]*limiter
+	userCaches   map[string]*responseCache
+	logger       *slog.Logger
+	cfg          *config.Config
+	configFile   string
+	transport    *dispatchTransport
 }
 
 func (rp *reverseProxy) getRequestScope(req *http.Request) (*scope, error) {
-	name, password := basicAuth(req)
-
 	rp.Lock()
 	defer rp.Unlock()
 
-	iu, ok := rp.users[name]
-	if !ok {
-		return nil, fmt.Errorf("invalid username or password for user %q", name)
-	}
-
-	if iu.password != password {
-		return nil, fmt.Errorf("invalid username or password for user %q", name)
+	var iu *initialUser
+	if cn := clientCertName(req); cn != "" {
+		// mTLS: the client cert's CN is trusted in place of a password
+		u, ok := rp.users[cn]
+		if !ok {
+			return nil, fmt.Errorf("invalid client certificate: no such user %q", cn)
+		}
+		iu = u
+	} else {
+		name, password := basicAuth(req)
+		u, ok := rp.users[name]
+		if !ok || u.password != password {
+			return nil, fmt.Errorf("invalid username or password for user %q", name)
+		}
+		iu = u
 	}
 
 	c, ok := rp.clusters[iu.toCluster]
@@ -215,22 +486,50 @@ func (rp *reverseProxy) getRequestScope(req *http.Request) (*scope, error) {
 		return nil, fmt.Errorf("BUG: user %q matches to unknown user %q at cluster %q", iu.name, iu.toUser, iu.toCluster)
 	}
 
+	// host is deliberately left unresolved here: picking one requires at
+	// least one healthy host, and a cacheable request whose answer is
+	// already sitting in the response cache shouldn't be rejected just
+	// because every host in its cluster is currently ejected. Callers that
+	// actually need to reach a backend resolve it via scope.resolveHost.
 	return &scope{
 		initialUser:   iu,
 		executionUser: eu,
 		cluster:       c,
-		host:          c.getHost(),
 	}, nil
 }
 
+// resolveHost lazily assigns s.host to the least-loaded currently-healthy
+// host in s.cluster, failing if none is available. It's a no-op once a
+// host has already been resolved, and is only called by the code paths
+// that actually need to reach a backend (proxyRequest's callers), not by
+// getRequestScope itself.
+func (s *scope) resolveHost() error {
+	if s.host != nil {
+		return nil
+	}
+
+	h, err := s.cluster.getHost()
+	if err != nil {
+		return fmt.Errorf("cluster %q: %s", s.cluster.name, err)
+	}
+	s.host = h
+	return nil
+}
+
 type cluster struct {
 	sync.Mutex
+	name  string
 	hosts []*host
 	users map[string]*executionUser
+
+	transport    *observableTransport
+	transportCfg transportSettings
+
+	limiter *limiter
 }
 
 // We don't use query_id because of distributed processing, the query ID is not passed to remote servers
-func (c *cluster) killQueries(condition string, elapsed float64) {
+func (c *cluster) killQueries(logger *slog.Logger, condition string, elapsed float64) {
 	c.Lock()
 	addrs := make([]string, len(c.hosts))
 	for i, host := range c.hosts {
@@ -239,24 +538,30 @@ func (c *cluster) killQueries(condition string, elapsed float64) {
 	c.Unlock()
 
 	q := fmt.Sprintf("KILL QUERY WHERE %s AND elapsed >= %d", condition, int(elapsed))
-	log.Debugf("ExecutionTime exceeded. Going to call query %q for hosts %v", q, addrs)
+	logger.Debug("execution time exceeded, killing queries", "query", q, "hosts", addrs)
 	for _, addr := range addrs {
 		if err := doQuery(q, addr); err != nil {
-			log.Errorf("error while killing queries older than %.2fs with condition %q: %s", elapsed, condition, err)
+			logger.Error("error while killing queries", "elapsed", elapsed, "condition", condition, "err", err)
 		}
 	}
 }
 
-func (c *cluster) getHost() *host {
+// getHost picks the least loaded currently-healthy host.
+// It returns an error if every host in the cluster is unhealthy.
+func (c *cluster) getHost() (*host, error) {
 	c.Lock()
 	defer c.Unlock()
 
 	var idle *host
 	for _, t := range c.hosts {
+		if !t.isHealthy() {
+			continue
+		}
+
 		t.Lock()
 		if t.runningQueries == 0 {
 			t.Unlock()
-			return t
+			return t, nil
 		}
 
 		if idle == nil || idle.runningQueries > t.runningQueries {
@@ -265,7 +570,46 @@ func (c *cluster) getHost() *host {
 		t.Unlock()
 	}
 
-	return idle
+	if idle == nil {
+		return nil, fmt.Errorf("no healthy hosts left in cluster")
+	}
+
+	return idle, nil
+}
+
+// startHealthCheck (re)starts the background health-check loop for every
+// host in the cluster, stopping any previously running checkers first
+func (c *cluster) startHealthCheck(cfg config.HealthCheck, user, password string, logger *slog.Logger) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, h := range c.hosts {
+		h.logger = logger.With("cluster", c.name, "host", h.addr.Host)
+		if h.stop != nil {
+			close(h.stop)
+		}
+		stop := make(chan struct{})
+		h.stop = stop
+		// pass stop explicitly rather than letting runHealthCheck read
+		// h.stop itself: hosts are reused across reloads, and if a reload
+		// lands while this goroutine is blocked inside h.probe(), the old
+		// goroutine must keep watching the channel it was started with,
+		// not whatever startHealthCheck has since written to h.stop
+		go h.runHealthCheck(stop, cfg, user, password)
+	}
+}
+
+// stopHealthCheck stops all running health-checkers for the cluster
+func (c *cluster) stopHealthCheck() {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, h := range c.hosts {
+		if h.stop != nil {
+			close(h.stop)
+			h.stop = nil
+		}
+	}
 }
 
 type observableTransport struct {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/hagen1778/chproxy/config"
+)
+
+// ListenAndServe starts the main proxy listener, serving plain HTTP unless
+// cfg.HTTPS is configured, in which case it serves HTTPS (optionally mTLS)
+func ListenAndServe(rp *reverseProxy, cfg config.Server) error {
+	if cfg.HTTPS.CertFile == "" && cfg.HTTPS.KeyFile == "" {
+		return http.ListenAndServe(cfg.ListenAddr, rp)
+	}
+
+	tlsConfig, err := buildServerTLSConfig(cfg.HTTPS)
+	if err != nil {
+		return fmt.Errorf("can't build server TLS config: %s", err)
+	}
+
+	server := &http.Server{
+		Addr:      cfg.ListenAddr,
+		Handler:   rp,
+		TLSConfig: tlsConfig,
+	}
+	return server.ListenAndServeTLS(cfg.HTTPS.CertFile, cfg.HTTPS.KeyFile)
+}
+
+// buildServerTLSConfig turns server.https into a *tls.Config for the
+// ingress listener, wiring up mTLS client-cert auth when configured
+func buildServerTLSConfig(cfg config.HTTPS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: minTLSVersion(cfg.MinVersion),
+	}
+
+	if len(cfg.CipherSuites) > 0 {
+		ids, err := cipherSuiteIDs(cfg.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = ids
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		// VerifyClientCertIfGiven: mTLS clients authenticate via CN, everyone
+		// else falls back to basic auth in reverseProxy.getRequestScope
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+func minTLSVersion(v string) uint16 {
+	switch v {
+	case "TLS1.3":
+		return tls.VersionTLS13
+	case "TLS1.1":
+		return tls.VersionTLS11
+	case "TLS1.0":
+		return tls.VersionTLS10
+	default:
+		return tls.VersionTLS12
+	}
+}
+
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	known := make(map[string]uint16, len(names))
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// clientCertName returns the CN of the client certificate presented for
+// this request, or "" if none was presented
+func clientCertName(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return req.TLS.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hagen1778/chproxy/config"
+)
+
+// dispatchTransport routes an outgoing request to the per-cluster
+// *observableTransport responsible for its target host. ApplyConfig swaps
+// the whole registry in place on reload, reusing transports whose cluster
+// settings are unchanged so their idle connection pools survive.
+type dispatchTransport struct {
+	mu     sync.RWMutex
+	byHost map[string]*observableTransport
+}
+
+func newDispatchTransport() *dispatchTransport {
+	return &dispatchTransport{byHost: make(map[string]*observableTransport)}
+}
+
+func (d *dispatchTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	d.mu.RLock()
+	t, ok := d.byHost[r.URL.Host]
+	d.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no transport configured for host %q", r.URL.Host)
+	}
+	return t.RoundTrip(r)
+}
+
+func (d *dispatchTransport) set(byHost map[string]*observableTransport) {
+	d.mu.Lock()
+	d.byHost = byHost
+	d.mu.Unlock()
+}
+
+// transportSettings is the subset of a cluster's config that buildTransport
+// actually consumes. ApplyConfig compares this instead of the whole
+// config.Cluster to decide whether a reload can reuse the previous
+// *observableTransport (and its idle connection pool): an unrelated change
+// elsewhere in the cluster block (limits, health_check, ...) shouldn't force
+// a rebuild.
+type transportSettings struct {
+	DialTimeout         time.Duration
+	ReadTimeout         time.Duration
+	WriteTimeout        time.Duration
+	KeepAlive           time.Duration
+	MaxIdleConnsPerHost int
+	TLSHandshakeTimeout time.Duration
+	TLSConfig           config.TLSConfig
+}
+
+// newTransportSettings extracts the transport-affecting subset of cfg
+func newTransportSettings(cfg config.Cluster) transportSettings {
+	return transportSettings{
+		DialTimeout:         cfg.DialTimeout,
+		ReadTimeout:         cfg.ReadTimeout,
+		WriteTimeout:        cfg.WriteTimeout,
+		KeepAlive:           cfg.KeepAlive,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		TLSHandshakeTimeout: cfg.TLSHandshakeTimeout,
+		TLSConfig:           cfg.TLSConfig,
+	}
+}
+
+// buildTransport creates an *observableTransport for a cluster according to
+// its configured dial/read/write timeouts and tls_config block
+func buildTransport(cfg config.Cluster) (*observableTransport, error) {
+	tlsConfig, err := buildClusterTLSConfig(cfg.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("can't build TLS config: %s", err)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+		DualStack: true,
+	}
+	rw := rwDeadlines{read: cfg.ReadTimeout, write: cfg.WriteTimeout}
+
+	return &observableTransport{
+		http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return rw.wrap(conn), nil
+			},
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		},
+	}, nil
+}
+
+// buildClusterTLSConfig turns a cluster's tls_config block into a
+// *tls.Config for dialing that cluster's backends, or nil if unset
+func buildClusterTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client cert/key pair: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %q: %s", file, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificates found in %q", file)
+	}
+	return pool, nil
+}
+
+// rwDeadlines enforces read/write deadlines on a dialed connection, since
+// http.Transport itself has no per-request read/write timeout knobs
+type rwDeadlines struct {
+	read  time.Duration
+	write time.Duration
+}
+
+func (d rwDeadlines) wrap(conn net.Conn) net.Conn {
+	if d.read == 0 && d.write == 0 {
+		return conn
+	}
+	return &deadlineConn{Conn: conn, rwDeadlines: d}
+}
+
+type deadlineConn struct {
+	net.Conn
+	rwDeadlines
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.read > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.read))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.write > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	return c.Conn.Write(b)
+}